@@ -0,0 +1,45 @@
+package common
+
+import "fmt"
+
+// ValidateSSHAuthMethod checks that exactly one SSH authentication method is
+// configured for the build: a Packer-generated temporary key pair, an
+// existing EC2 key pair, a user-supplied private key file, a password, or
+// ssh agent auth. It exists so that StepCreateSSMTunnel can be told
+// unambiguously whether it owns a temporary key pair that needs its public
+// half pushed to the instance (see StepCreateSSMTunnel.GenerateSSHKeyPair).
+//
+// It is not called anywhere in this tree: the RunConfig.Prepare call site
+// that should invoke it before building the SSM/SSH steps lives in the
+// hashicorp/packer-plugin-amazon dependency, not this repo, the same
+// out-of-tree situation as the session-manager-plugin streaming noted on
+// StepCreateSSMTunnel.CreatePersistentSSMSession.
+func ValidateSSHAuthMethod(temporaryKeyPairName, sshKeyPairName, sshPrivateKeyFile, sshPassword string, sshAgentAuth bool) []error {
+	var errs []error
+
+	methods := 0
+	if temporaryKeyPairName != "" {
+		methods++
+	}
+	if sshKeyPairName != "" {
+		methods++
+	}
+	if sshPrivateKeyFile != "" {
+		methods++
+	}
+	if sshPassword != "" {
+		methods++
+	}
+	if sshAgentAuth {
+		methods++
+	}
+
+	if methods == 0 {
+		errs = append(errs, fmt.Errorf("one of temporary_key_pair_name (default), ssh_keypair_name, ssh_private_key_file, ssh_password, or ssh_agent_auth must be set"))
+	}
+	if methods > 1 {
+		errs = append(errs, fmt.Errorf("only one of temporary_key_pair_name, ssh_keypair_name, ssh_private_key_file, ssh_password, or ssh_agent_auth may be set"))
+	}
+
+	return errs
+}
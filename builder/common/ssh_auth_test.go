@@ -0,0 +1,30 @@
+package common
+
+import "testing"
+
+func TestValidateSSHAuthMethod(t *testing.T) {
+	tests := []struct {
+		name                                                                 string
+		temporaryKeyPairName, sshKeyPairName, sshPrivateKeyFile, sshPassword string
+		sshAgentAuth                                                         bool
+		wantErrs                                                             int
+	}{
+		{name: "none configured", wantErrs: 1},
+		{name: "temporary key pair only", temporaryKeyPairName: "packer_123", wantErrs: 0},
+		{name: "existing key pair only", sshKeyPairName: "my-keypair", wantErrs: 0},
+		{name: "private key file only", sshPrivateKeyFile: "/tmp/id_rsa", wantErrs: 0},
+		{name: "password only", sshPassword: "hunter2", wantErrs: 0},
+		{name: "agent auth only", sshAgentAuth: true, wantErrs: 0},
+		{name: "temporary key pair and password", temporaryKeyPairName: "packer_123", sshPassword: "hunter2", wantErrs: 1},
+		{name: "key pair and private key file and agent auth", sshKeyPairName: "my-keypair", sshPrivateKeyFile: "/tmp/id_rsa", sshAgentAuth: true, wantErrs: 1},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			errs := ValidateSSHAuthMethod(tt.temporaryKeyPairName, tt.sshKeyPairName, tt.sshPrivateKeyFile, tt.sshPassword, tt.sshAgentAuth)
+			if len(errs) != tt.wantErrs {
+				t.Errorf("ValidateSSHAuthMethod() returned %d errors (%v), want %d", len(errs), errs, tt.wantErrs)
+			}
+		})
+	}
+}
@@ -0,0 +1,383 @@
+package common
+
+import (
+	"bytes"
+	"context"
+	"crypto/sha256"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/service/ssm"
+	"github.com/gorilla/websocket"
+)
+
+// Session Manager message types, as documented by the session-manager-plugin
+// binary framing protocol.
+const (
+	ssmMessageInputStreamData  = "input_stream_data"
+	ssmMessageOutputStreamData = "output_stream_data"
+	ssmMessageAcknowledge      = "acknowledge"
+	ssmMessageChannelClosed    = "channel_closed"
+)
+
+// ssmAgentMessage is the binary frame exchanged over the Session Manager
+// WebSocket channel. Field order and sizes below follow the wire layout
+// used by session-manager-plugin: a 4-byte header length, followed by the
+// fixed header (MessageType first, immediately after the header length),
+// followed by a variable length payload.
+type ssmAgentMessage struct {
+	MessageType    string
+	SchemaVersion  uint32
+	CreatedDate    uint64
+	SequenceNumber int64
+	Flags          uint64
+	MessageID      [16]byte
+	PayloadDigest  [32]byte
+	PayloadType    uint32
+	Payload        []byte
+}
+
+// ssmAgentMessageHeaderLen is the size in bytes of everything between the
+// header length field and the payload: MessageType(32) + SchemaVersion(4) +
+// CreatedDate(8) + SequenceNumber(8) + Flags(8) + MessageID(16) +
+// PayloadDigest(32) + PayloadType(4) + PayloadLength(4).
+const ssmAgentMessageHeaderLen = 32 + 4 + 8 + 8 + 8 + 16 + 32 + 4 + 4
+
+// Flags set on an ssmAgentMessage, matching the bit values used by the
+// Session Manager binary framing protocol.
+const (
+	ssmFlagData = 0
+	ssmFlagAck  = 1
+	ssmFlagFin  = 4
+)
+
+func (m *ssmAgentMessage) encode() ([]byte, error) {
+	var buf bytes.Buffer
+
+	var typeBuf [32]byte
+	copy(typeBuf[:], m.MessageType)
+
+	if err := binary.Write(&buf, binary.BigEndian, uint32(ssmAgentMessageHeaderLen)); err != nil {
+		return nil, err
+	}
+	buf.Write(typeBuf[:])
+	if err := binary.Write(&buf, binary.BigEndian, m.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, m.CreatedDate); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, m.SequenceNumber); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, m.Flags); err != nil {
+		return nil, err
+	}
+	buf.Write(m.MessageID[:])
+	digest := sha256.Sum256(m.Payload)
+	buf.Write(digest[:])
+	if err := binary.Write(&buf, binary.BigEndian, m.PayloadType); err != nil {
+		return nil, err
+	}
+	if err := binary.Write(&buf, binary.BigEndian, uint32(len(m.Payload))); err != nil {
+		return nil, err
+	}
+	buf.Write(m.Payload)
+
+	return buf.Bytes(), nil
+}
+
+func decodeSSMAgentMessage(raw []byte) (*ssmAgentMessage, error) {
+	if len(raw) < 4+ssmAgentMessageHeaderLen {
+		return nil, fmt.Errorf("ssm: message too short: %d bytes", len(raw))
+	}
+
+	r := bytes.NewReader(raw)
+	m := &ssmAgentMessage{}
+
+	var headerLen uint32
+	if err := binary.Read(r, binary.BigEndian, &headerLen); err != nil {
+		return nil, err
+	}
+	var typeBuf [32]byte
+	if _, err := io.ReadFull(r, typeBuf[:]); err != nil {
+		return nil, err
+	}
+	m.MessageType = string(bytes.TrimRight(typeBuf[:], "\x00"))
+	if err := binary.Read(r, binary.BigEndian, &m.SchemaVersion); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &m.CreatedDate); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &m.SequenceNumber); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &m.Flags); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, m.MessageID[:]); err != nil {
+		return nil, err
+	}
+	if _, err := io.ReadFull(r, m.PayloadDigest[:]); err != nil {
+		return nil, err
+	}
+	if err := binary.Read(r, binary.BigEndian, &m.PayloadType); err != nil {
+		return nil, err
+	}
+	var payloadLen uint32
+	if err := binary.Read(r, binary.BigEndian, &payloadLen); err != nil {
+		return nil, err
+	}
+
+	m.Payload = make([]byte, payloadLen)
+	if _, err := io.ReadFull(r, m.Payload); err != nil {
+		return nil, err
+	}
+
+	return m, nil
+}
+
+type ssmOpenDataChannelInput struct {
+	MessageSchemaVersion string `json:"MessageSchemaVersion"`
+	RequestID            string `json:"RequestId"`
+	TokenValue           string `json:"TokenValue"`
+}
+
+// ssmNativeTunnel opens the WebSocket channel returned by ssm:StartSession
+// and forwards bytes between it and a local net.Listener, speaking the
+// Session Manager client handshake in-process instead of shelling out to
+// session-manager-plugin.
+type ssmNativeTunnel struct {
+	StreamURL  string
+	TokenValue string
+	SessionID  string
+
+	conn     *websocket.Conn
+	writeMu  sync.Mutex
+	outSeq   int64
+	inSeqAck int64
+}
+
+// writeMessage sends raw over the WebSocket connection. gorilla/websocket
+// allows at most one concurrent writer per connection; writeToChannel and
+// acknowledge (via readFromChannel) both write from separate goroutines, so
+// every write goes through this method.
+func (t *ssmNativeTunnel) writeMessage(raw []byte) error {
+	t.writeMu.Lock()
+	defer t.writeMu.Unlock()
+	return t.conn.WriteMessage(websocket.BinaryMessage, raw)
+}
+
+func (t *ssmNativeTunnel) connect(ctx context.Context) error {
+	dialer := websocket.DefaultDialer
+	conn, _, err := dialer.DialContext(ctx, t.StreamURL, nil)
+	if err != nil {
+		return fmt.Errorf("ssm: failed to dial data channel: %w", err)
+	}
+	t.conn = conn
+
+	open := ssmOpenDataChannelInput{
+		MessageSchemaVersion: "1.0",
+		RequestID:            t.SessionID,
+		TokenValue:           t.TokenValue,
+	}
+	payload, err := json.Marshal(open)
+	if err != nil {
+		return err
+	}
+
+	seq := atomic.AddInt64(&t.outSeq, 1) - 1
+	msg := ssmAgentMessage{
+		MessageType:    ssmMessageInputStreamData,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		SequenceNumber: seq,
+		Payload:        payload,
+	}
+	raw, err := msg.encode()
+	if err != nil {
+		return err
+	}
+	return t.writeMessage(raw)
+}
+
+// Serve accepts connections on l and pipes each to the SSM data channel
+// until ctx is cancelled. Session Manager only supports a single active
+// stream per session, so only one connection is served at a time.
+func (t *ssmNativeTunnel) Serve(ctx context.Context, l net.Listener) error {
+	if err := t.connect(ctx); err != nil {
+		return err
+	}
+	defer t.conn.Close()
+
+	// Accept blocks until the listener is closed, so close it on
+	// cancellation to let Serve return.
+	go func() {
+		<-ctx.Done()
+		l.Close()
+	}()
+
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return nil
+			}
+			return err
+		}
+
+		if err := t.pipe(ctx, conn); err != nil {
+			log.Printf("[ERROR] ssm native tunnel: %s", err)
+		}
+		conn.Close()
+
+		if ctx.Err() != nil {
+			return nil
+		}
+	}
+}
+
+func (t *ssmNativeTunnel) pipe(ctx context.Context, local net.Conn) error {
+	errCh := make(chan error, 2)
+
+	go func() {
+		errCh <- t.readFromChannel(ctx, local)
+	}()
+	go func() {
+		errCh <- t.writeToChannel(local)
+	}()
+
+	select {
+	case err := <-errCh:
+		return err
+	case <-ctx.Done():
+		return nil
+	}
+}
+
+func (t *ssmNativeTunnel) writeToChannel(local net.Conn) error {
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := local.Read(buf)
+		if n > 0 {
+			seq := atomic.AddInt64(&t.outSeq, 1) - 1
+			msg := ssmAgentMessage{
+				MessageType:    ssmMessageInputStreamData,
+				SchemaVersion:  1,
+				CreatedDate:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+				SequenceNumber: seq,
+				Flags:          ssmFlagData,
+				Payload:        buf[:n],
+			}
+			raw, encErr := msg.encode()
+			if encErr != nil {
+				return encErr
+			}
+			if writeErr := t.writeMessage(raw); writeErr != nil {
+				return writeErr
+			}
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+func (t *ssmNativeTunnel) readFromChannel(ctx context.Context, local net.Conn) error {
+	for {
+		_, raw, err := t.conn.ReadMessage()
+		if err != nil {
+			return err
+		}
+
+		msg, err := decodeSSMAgentMessage(raw)
+		if err != nil {
+			return fmt.Errorf("ssm: decoding agent message: %w", err)
+		}
+
+		switch msg.MessageType {
+		case ssmMessageOutputStreamData:
+			if _, err := local.Write(msg.Payload); err != nil {
+				return err
+			}
+			if err := t.acknowledge(msg); err != nil {
+				return err
+			}
+		case ssmMessageChannelClosed:
+			return io.EOF
+		}
+	}
+}
+
+func (t *ssmNativeTunnel) acknowledge(msg *ssmAgentMessage) error {
+	ack := struct {
+		AcknowledgedMessageType           string `json:"AcknowledgedMessageType"`
+		AcknowledgedMessageId             string `json:"AcknowledgedMessageId"`
+		AcknowledgedMessageSequenceNumber int64  `json:"AcknowledgedMessageSequenceNumber"`
+		IsSequentialMessage               bool   `json:"IsSequentialMessage"`
+	}{
+		AcknowledgedMessageType:           msg.MessageType,
+		AcknowledgedMessageId:             fmt.Sprintf("%x", msg.MessageID),
+		AcknowledgedMessageSequenceNumber: msg.SequenceNumber,
+		IsSequentialMessage:               true,
+	}
+	payload, err := json.Marshal(ack)
+	if err != nil {
+		return err
+	}
+
+	ackMsg := ssmAgentMessage{
+		MessageType:    ssmMessageAcknowledge,
+		SchemaVersion:  1,
+		CreatedDate:    uint64(time.Now().UnixNano() / int64(time.Millisecond)),
+		SequenceNumber: atomic.AddInt64(&t.inSeqAck, 1) - 1,
+		Flags:          ssmFlagAck,
+		Payload:        payload,
+	}
+	raw, err := ackMsg.encode()
+	if err != nil {
+		return err
+	}
+	return t.writeMessage(raw)
+}
+
+// startNativeSSMTunnel calls ssm:StartSession directly and serves the
+// resulting WebSocket channel on l, without depending on the external
+// session-manager-plugin binary. startTimeout bounds how long to retry
+// StartSession while the instance's SSM Agent hasn't registered yet; see
+// startSessionWithRetry. onSessionStart, if non-nil, is called with the
+// session id once StartSession succeeds, so callers can correlate the
+// Packer run with the corresponding SSM session in CloudTrail.
+func startNativeSSMTunnel(ctx context.Context, ssmconn *ssm.SSM, instanceID string, l net.Listener, remotePort int, startTimeout time.Duration, onSessionStart func(sessionID string)) error {
+	out, err := startSessionWithRetry(ctx, ssmconn, &ssm.StartSessionInput{
+		Target:       aws.String(instanceID),
+		DocumentName: aws.String("AWS-StartPortForwardingSession"),
+		Parameters: map[string][]*string{
+			"portNumber": {aws.String(fmt.Sprintf("%d", remotePort))},
+		},
+	}, startTimeout)
+	if err != nil {
+		return fmt.Errorf("ssm: StartSession failed: %w", err)
+	}
+
+	tunnel := &ssmNativeTunnel{
+		StreamURL:  aws.StringValue(out.StreamUrl),
+		TokenValue: aws.StringValue(out.TokenValue),
+		SessionID:  aws.StringValue(out.SessionId),
+	}
+
+	if onSessionStart != nil {
+		onSessionStart(tunnel.SessionID)
+	}
+
+	return tunnel.Serve(ctx, l)
+}
@@ -0,0 +1,118 @@
+package common
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/binary"
+	"testing"
+)
+
+// buildCapturedFrame hand-assembles the bytes for an output_stream_data
+// message per the documented session-manager-plugin wire layout: header
+// length, then MessageType, SchemaVersion, CreatedDate, SequenceNumber,
+// Flags, MessageID, PayloadDigest, PayloadType, PayloadLength, Payload.
+// The bytes are written field by field here, independently of this
+// package's own encode(), rather than just round-tripping through it.
+func buildCapturedFrame(t *testing.T) []byte {
+	t.Helper()
+
+	payload := []byte("hello from the instance\n")
+	digest := sha256.Sum256(payload)
+
+	var messageID [16]byte
+	copy(messageID[:], bytes.Repeat([]byte{0xAB}, 16))
+
+	var typeBuf [32]byte
+	copy(typeBuf[:], ssmMessageOutputStreamData)
+
+	var buf bytes.Buffer
+	write := func(v interface{}) {
+		if err := binary.Write(&buf, binary.BigEndian, v); err != nil {
+			t.Fatalf("building captured frame: %s", err)
+		}
+	}
+
+	write(uint32(ssmAgentMessageHeaderLen))
+	buf.Write(typeBuf[:])
+	write(uint32(1))             // SchemaVersion
+	write(uint64(1700000000123)) // CreatedDate
+	write(int64(42))             // SequenceNumber
+	write(uint64(ssmFlagData))   // Flags
+	buf.Write(messageID[:])
+	buf.Write(digest[:])
+	write(uint32(1))            // PayloadType
+	write(uint32(len(payload))) // PayloadLength
+	buf.Write(payload)
+
+	return buf.Bytes()
+}
+
+func TestDecodeSSMAgentMessage_CapturedFrame(t *testing.T) {
+	raw := buildCapturedFrame(t)
+
+	msg, err := decodeSSMAgentMessage(raw)
+	if err != nil {
+		t.Fatalf("decodeSSMAgentMessage: %s", err)
+	}
+
+	if msg.MessageType != ssmMessageOutputStreamData {
+		t.Errorf("MessageType = %q, want %q", msg.MessageType, ssmMessageOutputStreamData)
+	}
+	if msg.SchemaVersion != 1 {
+		t.Errorf("SchemaVersion = %d, want 1", msg.SchemaVersion)
+	}
+	if msg.SequenceNumber != 42 {
+		t.Errorf("SequenceNumber = %d, want 42", msg.SequenceNumber)
+	}
+	if string(msg.Payload) != "hello from the instance\n" {
+		t.Errorf("Payload = %q, want %q", msg.Payload, "hello from the instance\n")
+	}
+}
+
+func TestSSMAgentMessageEncodeDecodeRoundTrip(t *testing.T) {
+	var messageID [16]byte
+	copy(messageID[:], bytes.Repeat([]byte{0x11}, 16))
+
+	original := ssmAgentMessage{
+		MessageType:    ssmMessageInputStreamData,
+		SchemaVersion:  1,
+		CreatedDate:    1700000000123,
+		SequenceNumber: 7,
+		Flags:          ssmFlagAck,
+		MessageID:      messageID,
+		PayloadType:    1,
+		Payload:        []byte("some bytes to forward"),
+	}
+
+	raw, err := original.encode()
+	if err != nil {
+		t.Fatalf("encode: %s", err)
+	}
+
+	decoded, err := decodeSSMAgentMessage(raw)
+	if err != nil {
+		t.Fatalf("decodeSSMAgentMessage: %s", err)
+	}
+
+	if decoded.MessageType != original.MessageType {
+		t.Errorf("MessageType = %q, want %q", decoded.MessageType, original.MessageType)
+	}
+	if decoded.SequenceNumber != original.SequenceNumber {
+		t.Errorf("SequenceNumber = %d, want %d", decoded.SequenceNumber, original.SequenceNumber)
+	}
+	if decoded.Flags != original.Flags {
+		t.Errorf("Flags = %d, want %d", decoded.Flags, original.Flags)
+	}
+	if decoded.MessageID != original.MessageID {
+		t.Errorf("MessageID = %x, want %x", decoded.MessageID, original.MessageID)
+	}
+	if !bytes.Equal(decoded.Payload, original.Payload) {
+		t.Errorf("Payload = %q, want %q", decoded.Payload, original.Payload)
+	}
+}
+
+func TestDecodeSSMAgentMessage_TooShort(t *testing.T) {
+	if _, err := decodeSSMAgentMessage([]byte{0, 0, 0, 1}); err == nil {
+		t.Fatal("expected error for short message, got nil")
+	}
+}
@@ -0,0 +1,77 @@
+package common
+
+import (
+	"context"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+const (
+	ssmStartSessionInitialBackoff = 200 * time.Millisecond
+	ssmStartSessionBackoffFactor  = 2
+	ssmStartSessionMaxBackoff     = 60 * time.Second
+)
+
+// ssmStartSessionCaller is the ssm:StartSession call used by
+// startSessionWithRetry, factored out as a variable so tests can substitute
+// a fake without a real *ssm.SSM client.
+var ssmStartSessionCaller = func(ctx context.Context, ssmconn *ssm.SSM, input *ssm.StartSessionInput) (*ssm.StartSessionOutput, error) {
+	return ssmconn.StartSessionWithContext(ctx, input)
+}
+
+// isRetryableSSMStartSessionError reports whether err is a transient
+// ssm:StartSession failure that's worth retrying, namely the instance's SSM
+// Agent not having registered with the service yet. This is common
+// immediately after boot.
+func isRetryableSSMStartSessionError(err error) bool {
+	awsErr, ok := err.(awserr.Error)
+	if !ok {
+		return false
+	}
+
+	switch awsErr.Code() {
+	case "TargetNotConnected", "TargetNotFound":
+		return true
+	}
+
+	return strings.Contains(awsErr.Message(), "TargetNotConnected") ||
+		strings.Contains(awsErr.Message(), "is not connected")
+}
+
+// startSessionWithRetry calls ssm:StartSession, retrying with exponential
+// backoff while the instance's SSM Agent hasn't registered yet. timeout
+// bounds the overall time spent retrying; a non-positive timeout disables
+// retries entirely and behaves like a single call.
+func startSessionWithRetry(ctx context.Context, ssmconn *ssm.SSM, input *ssm.StartSessionInput, timeout time.Duration) (*ssm.StartSessionOutput, error) {
+	if timeout <= 0 {
+		return ssmStartSessionCaller(ctx, ssmconn, input)
+	}
+
+	deadline := time.Now().Add(timeout)
+	backoff := ssmStartSessionInitialBackoff
+
+	for {
+		out, err := ssmStartSessionCaller(ctx, ssmconn, input)
+		if err == nil || !isRetryableSSMStartSessionError(err) {
+			return out, err
+		}
+
+		if time.Now().Add(backoff).After(deadline) {
+			return nil, err
+		}
+
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return nil, ctx.Err()
+		}
+
+		backoff *= ssmStartSessionBackoffFactor
+		if backoff > ssmStartSessionMaxBackoff {
+			backoff = ssmStartSessionMaxBackoff
+		}
+	}
+}
@@ -0,0 +1,95 @@
+package common
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws/awserr"
+	"github.com/aws/aws-sdk-go/service/ssm"
+)
+
+func TestIsRetryableSSMStartSessionError(t *testing.T) {
+	tests := []struct {
+		name string
+		err  error
+		want bool
+	}{
+		{"nil", nil, false},
+		{"non-aws error", errors.New("boom"), false},
+		{"TargetNotConnected code", awserr.New("TargetNotConnected", "instance is not connected", nil), true},
+		{"TargetNotFound code", awserr.New("TargetNotFound", "target not found", nil), true},
+		{"message contains TargetNotConnected", awserr.New("ValidationException", "ssm:StartSession failed: TargetNotConnected", nil), true},
+		{"message contains is not connected", awserr.New("SomeError", "the instance is not connected to Session Manager", nil), true},
+		{"unrelated aws error", awserr.New("AccessDeniedException", "not authorized", nil), false},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			if got := isRetryableSSMStartSessionError(tt.err); got != tt.want {
+				t.Errorf("isRetryableSSMStartSessionError(%v) = %v, want %v", tt.err, got, tt.want)
+			}
+		})
+	}
+}
+
+func TestStartSessionWithRetry_NoTimeoutDisablesRetries(t *testing.T) {
+	calls := 0
+	orig := ssmStartSessionCaller
+	defer func() { ssmStartSessionCaller = orig }()
+	ssmStartSessionCaller = func(ctx context.Context, ssmconn *ssm.SSM, input *ssm.StartSessionInput) (*ssm.StartSessionOutput, error) {
+		calls++
+		return nil, awserr.New("TargetNotConnected", "instance is not connected", nil)
+	}
+
+	_, err := startSessionWithRetry(context.Background(), nil, &ssm.StartSessionInput{}, 0)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if calls != 1 {
+		t.Errorf("expected exactly 1 call with a zero timeout, got %d", calls)
+	}
+}
+
+func TestStartSessionWithRetry_RetriesThenSucceeds(t *testing.T) {
+	calls := 0
+	orig := ssmStartSessionCaller
+	defer func() { ssmStartSessionCaller = orig }()
+	ssmStartSessionCaller = func(ctx context.Context, ssmconn *ssm.SSM, input *ssm.StartSessionInput) (*ssm.StartSessionOutput, error) {
+		calls++
+		if calls < 3 {
+			return nil, awserr.New("TargetNotConnected", "instance is not connected", nil)
+		}
+		return &ssm.StartSessionOutput{}, nil
+	}
+
+	out, err := startSessionWithRetry(context.Background(), nil, &ssm.StartSessionInput{}, time.Second)
+	if err != nil {
+		t.Fatalf("startSessionWithRetry: %s", err)
+	}
+	if out == nil {
+		t.Fatal("expected a non-nil output on success")
+	}
+	if calls != 3 {
+		t.Errorf("expected 3 calls, got %d", calls)
+	}
+}
+
+func TestStartSessionWithRetry_NonRetryableErrorStopsImmediately(t *testing.T) {
+	calls := 0
+	orig := ssmStartSessionCaller
+	defer func() { ssmStartSessionCaller = orig }()
+	ssmStartSessionCaller = func(ctx context.Context, ssmconn *ssm.SSM, input *ssm.StartSessionInput) (*ssm.StartSessionOutput, error) {
+		calls++
+		return nil, awserr.New("AccessDeniedException", "not authorized", nil)
+	}
+
+	_, err := startSessionWithRetry(context.Background(), nil, &ssm.StartSessionInput{}, time.Second)
+	if err == nil {
+		t.Fatal("expected error, got nil")
+	}
+	if calls != 1 {
+		t.Errorf("expected exactly 1 call for a non-retryable error, got %d", calls)
+	}
+}
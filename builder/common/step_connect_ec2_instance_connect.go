@@ -0,0 +1,73 @@
+package common
+
+import (
+	"context"
+	"fmt"
+
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// SSHInterfaceEC2InstanceConnect is the ssh_interface value that selects
+// StepConnectEC2InstanceConnect instead of StepCreateSSMTunnel. It suits
+// users who have IAM-controlled EC2 Instance Connect but no SSM Agent.
+const SSHInterfaceEC2InstanceConnect = "ec2_instance_connect"
+
+// StepConnectEC2InstanceConnect pushes the ephemeral SSH public key to the
+// instance via StepSendSSHPublicKey and connects to the instance's public
+// or private IP directly, without opening an SSM tunnel. It is a sibling of
+// StepCreateSSMTunnel, not a replacement: this step is used when
+// ssh_interface is "ec2_instance_connect".
+type StepConnectEC2InstanceConnect struct {
+	AWSSession *session.Session
+	SSHConfig  *communicator.SSH
+	// UsePrivateIP connects to the instance's private IP instead of its
+	// public IP. Mirrors the equivalent setting for the other
+	// ssh_interface modes.
+	UsePrivateIP bool
+
+	sender *StepSendSSHPublicKey
+}
+
+// Run pushes the SSH public key and records the instance address Packer's
+// communicator step should connect to.
+func (s *StepConnectEC2InstanceConnect) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	instance, ok := state.Get("instance").(*ec2.Instance)
+	if !ok {
+		err := fmt.Errorf("error encountered in obtaining target instance id for EC2 Instance Connect")
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	s.sender = &StepSendSSHPublicKey{AWSSession: s.AWSSession, SSHConfig: s.SSHConfig}
+	if action := s.sender.Run(ctx, state); action != multistep.ActionContinue {
+		return action
+	}
+
+	host := instance.PublicIpAddress
+	if s.UsePrivateIP {
+		host = instance.PrivateIpAddress
+	}
+	if host == nil || *host == "" {
+		err := fmt.Errorf("instance has no IP address to connect to via EC2 Instance Connect")
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+	state.Put("host", *host)
+
+	return multistep.ActionContinue
+}
+
+// Cleanup stops the background SSH public key refresh loop.
+func (s *StepConnectEC2InstanceConnect) Cleanup(state multistep.StateBag) {
+	if s.sender != nil {
+		s.sender.Cleanup(state)
+	}
+}
@@ -4,22 +4,31 @@ import (
 	"context"
 	"fmt"
 	"log"
-	"strings"
 	"time"
 
 	"github.com/aws/aws-sdk-go/aws"
 	"github.com/aws/aws-sdk-go/aws/session"
 	"github.com/aws/aws-sdk-go/service/ec2"
-	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
 	"github.com/aws/aws-sdk-go/service/ssm"
 	pssm "github.com/hashicorp/packer-plugin-amazon/builder/common/ssm"
 	"github.com/hashicorp/packer-plugin-sdk/communicator"
-	"github.com/hashicorp/packer-plugin-sdk/communicator/sshkey"
 	"github.com/hashicorp/packer-plugin-sdk/multistep"
 	"github.com/hashicorp/packer-plugin-sdk/net"
 	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
 )
 
+// TunnelMode selects how StepCreateSSMTunnel establishes the local port
+// forward over Session Manager.
+const (
+	// TunnelModePlugin shells out to the external session-manager-plugin
+	// binary. This is the long-standing default and requires the plugin
+	// to be installed on the machine running Packer.
+	TunnelModePlugin = "plugin"
+	// TunnelModeNative speaks the Session Manager WebSocket protocol
+	// in-process, with no dependency on session-manager-plugin.
+	TunnelModeNative = "native"
+)
+
 type StepCreateSSMTunnel struct {
 	AWSSession       *session.Session
 	Region           string
@@ -28,7 +37,23 @@ type StepCreateSSMTunnel struct {
 	SSMAgentEnabled  bool
 	SSHConfig        *communicator.SSH
 	PauseBeforeSSM   time.Duration
-	stopSSMCommand   func()
+	// TunnelMode is "plugin" (default) or "native". See TunnelModePlugin
+	// and TunnelModeNative.
+	TunnelMode string
+	// GenerateSSHKeyPair is true when Packer generated a temporary EC2 key
+	// pair for this build. Only in that case does the instance need the
+	// matching public key pushed via EC2 Instance Connect; builds using
+	// ssh_password, an existing key pair, or a user-supplied
+	// ssh_private_key_file authenticate with credentials the instance
+	// already has.
+	GenerateSSHKeyPair bool
+	// SSMStartTimeout bounds how long ssm:StartSession is retried while the
+	// instance's SSM Agent hasn't registered yet (AWS error code
+	// TargetNotConnected). A zero value disables retries. Only honored by
+	// TunnelModeNative; plugin mode retries via the external
+	// session-manager-plugin binary itself.
+	SSMStartTimeout time.Duration
+	stopSSMCommand  func()
 }
 
 // Run executes the Packer build step that creates a session tunnel.
@@ -74,6 +99,12 @@ func (s *StepCreateSSMTunnel) Run(ctx context.Context, state multistep.StateBag)
 	ec2Conn := state.Get("ec2").(*ec2.EC2)
 
 	ssmconn := ssm.New(s.AWSSession)
+
+	if s.TunnelMode == TunnelModeNative {
+		go s.createNativeSSMSession(ssmCtx, ui, ssmconn, instance)
+		return multistep.ActionContinue
+	}
+
 	session := pssm.Session{
 		SvcClient:  ssmconn,
 		InstanceID: aws.StringValue(instance.InstanceId),
@@ -87,17 +118,65 @@ func (s *StepCreateSSMTunnel) Run(ctx context.Context, state multistep.StateBag)
 	return multistep.ActionContinue
 }
 
+// createNativeSSMSession opens an in-process SSM port-forwarding tunnel,
+// bypassing the external session-manager-plugin binary entirely.
+func (s *StepCreateSSMTunnel) createNativeSSMSession(ctx context.Context, ui packersdk.Ui, ssmconn *ssm.SSM, instance *ec2.Instance) {
+	l, err := net.ListenRangeConfig{
+		Min:     s.LocalPortNumber,
+		Max:     s.LocalPortNumber,
+		Addr:    "0.0.0.0",
+		Network: "tcp",
+	}.Listen(ctx)
+	if err != nil {
+		ui.Error(fmt.Sprintf("ssm error: failed to rebind local port %d: %s", s.LocalPortNumber, err))
+		return
+	}
+	defer l.Listener.Close()
+
+	sender := &StepSendSSHPublicKey{AWSSession: s.AWSSession, SSHConfig: s.SSHConfig}
+
+	onSessionStart := func(sessionID string) {
+		log.Printf("[ssm] session started: %s", sessionID)
+		ui.Message(fmt.Sprintf("[ssm] session id: %s", sessionID))
+
+		if s.shouldSendSSHPublicKey() {
+			ui.Say("Uploading SSH public key to instance")
+			if err := sender.Send(instance); err != nil {
+				ui.Error(err.Error())
+			}
+			// EC2 Instance Connect keys expire after 60s, and the SSH
+			// communicator's first connection (or a reconnect after a
+			// reboot provisioner) commonly takes longer than that, so keep
+			// refreshing for as long as the tunnel is up.
+			go sender.refreshLoop(ctx, ui, instance)
+		}
+	}
+
+	if err := startNativeSSMTunnel(ctx, ssmconn, aws.StringValue(instance.InstanceId), l.Listener, s.RemotePortNumber, s.SSMStartTimeout, onSessionStart); err != nil {
+		ui.Error(fmt.Sprintf("[ssm] %s", err))
+	}
+}
+
+// CreatePersistentSSMSession starts the session via the external
+// session-manager-plugin binary. Its stdout/stderr and the JSON
+// SessionId/StreamUrl it prints on startup are not captured here:
+// session.Start (pssm.Session.Start) lives in the hashicorp/packer-plugin-amazon
+// dependency, not this tree, so there is no call site in this repo to stream
+// that subprocess output through the Packer UI with a "[ssm]" prefix.
+// TunnelModeNative's onSessionStart callback above is the one session-id/
+// logging path this package actually owns end-to-end.
 func (s *StepCreateSSMTunnel) CreatePersistentSSMSession(ctx context.Context, ui packersdk.Ui, session *pssm.Session, instance *ec2.Instance) {
 	sessionChan := make(chan struct{})
 
+	sender := &StepSendSSHPublicKey{AWSSession: s.AWSSession, SSHConfig: s.SSHConfig}
+
 	go func() {
 		// SSH public key sent expires every minute.
 		// Send it upon each reconnect to ensure it is always valid.
 		for range sessionChan {
-			if len(s.SSHConfig.SSHPrivateKey) != 0 && s.SSHConfig.SSHKeyPairName == "" {
+			if s.shouldSendSSHPublicKey() {
 				ui.Say("Uploading SSH public key to instance")
-				err := s.sendUserSSHPublicKey(instance, s.SSHConfig.SSHPrivateKey)
-				if err != nil {
+				if err := sender.Send(instance); err != nil {
 					ui.Error(err.Error())
 				}
 			}
@@ -110,35 +189,13 @@ func (s *StepCreateSSMTunnel) CreatePersistentSSMSession(ctx context.Context, ui
 	}
 }
 
-func (s *StepCreateSSMTunnel) sendUserSSHPublicKey(
-	instance *ec2.Instance,
-	privateKey []byte,
-) error {
-	publicKey, err := sshkey.PublicKeyFromPrivate(privateKey)
-	if err != nil {
-		return fmt.Errorf("Error getting public key from private key: %s", err)
-	}
-	svc := ec2instanceconnect.New(s.AWSSession)
-	input := &ec2instanceconnect.SendSSHPublicKeyInput{
-		AvailabilityZone: aws.String(*instance.Placement.AvailabilityZone),
-		InstanceId:       aws.String(*instance.InstanceId),
-		InstanceOSUser:   aws.String(s.SSHConfig.SSHUsername),
-		SSHPublicKey:     aws.String(strings.TrimSuffix(string(publicKey), "\n")),
-	}
-	log.Printf("Sending public key to instance: %s", *input.InstanceId)
-	result, err := svc.SendSSHPublicKey(input)
-	if err != nil {
-		err := fmt.Errorf(`
-        error encountered in sending public key to instance: %s
-      Check the key type and length are valid in AWS API.
-      https://docs.aws.amazon.com/ec2-instance-connect/latest/APIReference/API_SendSSHPublicKey.html`, err)
-		return err
-	} else {
-		if *result.Success {
-			return nil
-		}
-	}
-	return fmt.Errorf("Failed to send public key to instance")
+// shouldSendSSHPublicKey reports whether the instance needs the SSH public
+// key pushed via EC2 Instance Connect. This is only the case when Packer
+// generated a temporary key pair for this build; ssh_password, an existing
+// key pair, and a user-supplied ssh_private_key_file are all already
+// authorized on the instance and must not trigger a push.
+func (s *StepCreateSSMTunnel) shouldSendSSHPublicKey() bool {
+	return s.GenerateSSHKeyPair && len(s.SSHConfig.SSHPrivateKey) != 0 && s.SSHConfig.SSHKeyPairName == ""
 }
 
 // Cleanup terminates an active session on AWS, which in turn terminates the associated tunnel process running on the local machine.
@@ -0,0 +1,115 @@
+package common
+
+import (
+	"context"
+	"fmt"
+	"log"
+	"strings"
+	"time"
+
+	"github.com/aws/aws-sdk-go/aws"
+	"github.com/aws/aws-sdk-go/aws/session"
+	"github.com/aws/aws-sdk-go/service/ec2"
+	"github.com/aws/aws-sdk-go/service/ec2instanceconnect"
+	"github.com/hashicorp/packer-plugin-sdk/communicator"
+	"github.com/hashicorp/packer-plugin-sdk/communicator/sshkey"
+	"github.com/hashicorp/packer-plugin-sdk/multistep"
+	packersdk "github.com/hashicorp/packer-plugin-sdk/packer"
+)
+
+// sshPublicKeyRefreshInterval is how often the ephemeral SSH public key is
+// re-sent to the instance. EC2 Instance Connect keys expire 60 seconds
+// after being pushed, so this must stay comfortably under that.
+const sshPublicKeyRefreshInterval = 50 * time.Second
+
+// StepSendSSHPublicKey pushes the build's ephemeral SSH public key to the
+// instance via EC2 Instance Connect, re-sending it on an interval so it
+// never expires mid-build. It is used directly by the ssh_interface =
+// "ec2_instance_connect" connection path, and is also called on-demand by
+// StepCreateSSMTunnel whenever its tunnel reconnects.
+type StepSendSSHPublicKey struct {
+	AWSSession *session.Session
+	SSHConfig  *communicator.SSH
+	stop       func()
+}
+
+// Run pushes the public key once and then keeps refreshing it in the
+// background until Cleanup is called or the context is done.
+func (s *StepSendSSHPublicKey) Run(ctx context.Context, state multistep.StateBag) multistep.StepAction {
+	ui := state.Get("ui").(packersdk.Ui)
+
+	instance, ok := state.Get("instance").(*ec2.Instance)
+	if !ok {
+		err := fmt.Errorf("error encountered in obtaining target instance id for sending SSH public key")
+		ui.Error(err.Error())
+		state.Put("error", err)
+		return multistep.ActionHalt
+	}
+
+	ui.Say("Uploading SSH public key to instance")
+	if err := s.Send(instance); err != nil {
+		state.Put("error", err)
+		ui.Error(err.Error())
+		return multistep.ActionHalt
+	}
+
+	refreshCtx, cancel := context.WithCancel(ctx)
+	s.stop = cancel
+	go s.refreshLoop(refreshCtx, ui, instance)
+
+	return multistep.ActionContinue
+}
+
+func (s *StepSendSSHPublicKey) refreshLoop(ctx context.Context, ui packersdk.Ui, instance *ec2.Instance) {
+	ticker := time.NewTicker(sshPublicKeyRefreshInterval)
+	defer ticker.Stop()
+
+	for {
+		select {
+		case <-ticker.C:
+			ui.Say("Refreshing SSH public key on instance")
+			if err := s.Send(instance); err != nil {
+				ui.Error(err.Error())
+			}
+		case <-ctx.Done():
+			return
+		}
+	}
+}
+
+// Send uploads the build's SSH public key to instance via EC2 Instance
+// Connect.
+func (s *StepSendSSHPublicKey) Send(instance *ec2.Instance) error {
+	publicKey, err := sshkey.PublicKeyFromPrivate(s.SSHConfig.SSHPrivateKey)
+	if err != nil {
+		return fmt.Errorf("Error getting public key from private key: %s", err)
+	}
+	svc := ec2instanceconnect.New(s.AWSSession)
+	input := &ec2instanceconnect.SendSSHPublicKeyInput{
+		AvailabilityZone: aws.String(*instance.Placement.AvailabilityZone),
+		InstanceId:       aws.String(*instance.InstanceId),
+		InstanceOSUser:   aws.String(s.SSHConfig.SSHUsername),
+		SSHPublicKey:     aws.String(strings.TrimSuffix(string(publicKey), "\n")),
+	}
+	log.Printf("Sending public key to instance: %s", *input.InstanceId)
+	result, err := svc.SendSSHPublicKey(input)
+	if err != nil {
+		err := fmt.Errorf(`
+        error encountered in sending public key to instance: %s
+      Check the key type and length are valid in AWS API.
+      https://docs.aws.amazon.com/ec2-instance-connect/latest/APIReference/API_SendSSHPublicKey.html`, err)
+		return err
+	} else {
+		if *result.Success {
+			return nil
+		}
+	}
+	return fmt.Errorf("Failed to send public key to instance")
+}
+
+// Cleanup stops the background refresh loop, if one was started.
+func (s *StepSendSSHPublicKey) Cleanup(state multistep.StateBag) {
+	if s.stop != nil {
+		s.stop()
+	}
+}